@@ -1,56 +1,175 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	MongoURI = "mongodb://localhost:27017"
 )
 
-// Response represents the result structure in MongoDB
+// ActivityConfig mirrors the manifest entries read by the evaluator, so
+// the two tools stay in sync on which activities and databases exist.
+type ActivityConfig struct {
+	Name           string `yaml:"activity_name"`
+	DisplayName    string `yaml:"display_name"`
+	CSVPath        string `yaml:"csv_path"`
+	DBName         string `yaml:"db_name"`
+	AccuracyOutput string `yaml:"accuracy_output"`
+}
+
+// loadManifest reads the activity manifest (benchmarks.yaml by default,
+// or BENCHMARKS_MANIFEST if set) so adding a new activity is a
+// single-file change instead of a binary rebuild.
+func loadManifest() ([]ActivityConfig, error) {
+	path := os.Getenv("BENCHMARKS_MANIFEST")
+	if path == "" {
+		path = "benchmarks.yaml"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	var manifest struct {
+		Activities []ActivityConfig `yaml:"activities"`
+	}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", path, err)
+	}
+	if len(manifest.Activities) == 0 {
+		return nil, fmt.Errorf("manifest %s defines no activities", path)
+	}
+	return manifest.Activities, nil
+}
+
+// Response represents the result structure in MongoDB. ModelCompletion
+// is no longer stored inline; CompletionRef/PromptRef point into the
+// activity's GridFS bucket instead (see tree_go's Response and
+// uploadBatch), so a plain Find only needs to stream is_correct/
+// is_invalid plus these handful of small fields.
 type Response struct {
-	Premise         string  `bson:"premise"`
-	Choice1         string  `bson:"choice1"`
-	Choice2         string  `bson:"choice2"`
-	CausalQuestion  string  `bson:"causal_question"`
-	CorrectAnswer   string  `bson:"correct_answer"`
-	ModelAnswer     string  `bson:"model_answer"`
-	ModelCompletion string  `bson:"model_completion"`
-	IsCorrect       bool    `bson:"is_correct"`
-	IsInvalid       bool    `bson:"is_invalid"`
-	ProcessingTime  float64 `bson:"processing_time"`
+	SampleID         string              `bson:"sample_id"`
+	Premise          string              `bson:"premise"`
+	Choice1          string              `bson:"choice1"`
+	Choice2          string              `bson:"choice2"`
+	CausalQuestion   string              `bson:"causal_question"`
+	CorrectAnswer    string              `bson:"correct_answer"`
+	ModelAnswer      string              `bson:"model_answer"`
+	CompletionRef    *primitive.ObjectID `bson:"completion_ref,omitempty"`
+	CompletionHash   string              `bson:"completion_hash,omitempty"`
+	CompletionInline string              `bson:"completion_inline,omitempty"`
+	PromptRef        *primitive.ObjectID `bson:"prompt_ref,omitempty"`
+	IsCorrect        bool                `bson:"is_correct"`
+	IsInvalid        bool                `bson:"is_invalid"`
+	ProcessingTime   float64             `bson:"processing_time"`
+}
+
+// FailureRecord captures an incorrect or invalid row, with its completion
+// pulled back from GridFS, for offline failure analysis. Only produced
+// when --hydrate is set.
+type FailureRecord struct {
+	SampleID      string `json:"sample_id"`
+	ModelAnswer   string `json:"model_answer"`
+	CorrectAnswer string `json:"correct_answer"`
+	IsInvalid     bool   `json:"is_invalid"`
+	Completion    string `json:"completion"`
+}
+
+// hydrateRequested inspects the command line and environment for a
+// request to pull failed rows' completions back from GridFS.
+func hydrateRequested() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--hydrate" || arg == "-hydrate" {
+			return true
+		}
+	}
+	switch strings.ToLower(os.Getenv("HYDRATE")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
 }
 
-// calculateAccuracy calculates and saves accuracy for a given database
-func calculateAccuracy(client *mongo.Client, dbName, outputFile string) {
+// downloadCompletion pulls the GridFS file at id back into a string.
+func downloadCompletion(bucket *gridfs.Bucket, id primitive.ObjectID) (string, error) {
+	var buf bytes.Buffer
+	if _, err := bucket.DownloadToStream(id, &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// calculateAccuracy calculates and saves accuracy for a given database.
+// With hydrate set, it also pulls each incorrect/invalid row's completion
+// back from GridFS and writes it alongside the row to a failures file,
+// for offline failure analysis.
+func calculateAccuracy(client *mongo.Client, dbName, outputFile string, hydrate bool) {
 	db := client.Database(dbName)
 	resultsColl := db.Collection("results")
 
-	// Fetch all results
-	results, err := resultsColl.Find(context.Background(), bson.D{})
+	// Without hydrate, is_correct/is_invalid is all this needs, so the
+	// covering index on {is_correct, is_invalid} can answer the query
+	// without touching the full documents. _id must be explicitly
+	// excluded or Mongo projects it by default, which isn't in that
+	// index and would force it back to a full document scan.
+	projection := bson.D{{Key: "_id", Value: 0}, {Key: "is_correct", Value: 1}, {Key: "is_invalid", Value: 1}}
+	if hydrate {
+		projection = bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "sample_id", Value: 1},
+			{Key: "model_answer", Value: 1},
+			{Key: "correct_answer", Value: 1},
+			{Key: "completion_ref", Value: 1},
+			{Key: "completion_inline", Value: 1},
+			{Key: "is_correct", Value: 1},
+			{Key: "is_invalid", Value: 1},
+		}
+	}
+
+	findOpts := options.Find().SetProjection(projection)
+	if !hydrate {
+		// The filter is empty, so the planner would not pick the index on
+		// its own; hint it so the scan stays index-only.
+		findOpts.SetHint(bson.D{{Key: "is_correct", Value: 1}, {Key: "is_invalid", Value: 1}})
+	}
+	results, err := resultsColl.Find(context.Background(), bson.D{}, findOpts)
 	if err != nil {
 		log.Printf("Failed to fetch results from %s: %v", dbName, err)
 		return
 	}
 	defer results.Close(context.Background())
 
+	var bucket *gridfs.Bucket
+	if hydrate {
+		bucket, err = gridfs.NewBucket(db)
+		if err != nil {
+			log.Printf("Failed to open GridFS bucket for %s: %v", dbName, err)
+			hydrate = false
+		}
+	}
+
 	var total, correct, invalid int
-	var allResults []Response
+	var failures []FailureRecord
 	for results.Next(context.Background()) {
 		var res Response
 		if err := results.Decode(&res); err != nil {
 			log.Printf("Failed to decode result from %s: %v", dbName, err)
 			continue
 		}
-		allResults = append(allResults, res)
 		total++
 		if res.IsCorrect {
 			correct++
@@ -58,6 +177,23 @@ func calculateAccuracy(client *mongo.Client, dbName, outputFile string) {
 		if res.IsInvalid {
 			invalid++
 		}
+		if hydrate && !res.IsCorrect {
+			completion := res.CompletionInline
+			if res.CompletionRef != nil {
+				if text, err := downloadCompletion(bucket, *res.CompletionRef); err != nil {
+					log.Printf("Failed to hydrate completion for %s in %s: %v", res.SampleID, dbName, err)
+				} else {
+					completion = text
+				}
+			}
+			failures = append(failures, FailureRecord{
+				SampleID:      res.SampleID,
+				ModelAnswer:   res.ModelAnswer,
+				CorrectAnswer: res.CorrectAnswer,
+				IsInvalid:     res.IsInvalid,
+				Completion:    completion,
+			})
+		}
 	}
 
 	if total == 0 {
@@ -94,6 +230,21 @@ func calculateAccuracy(client *mongo.Client, dbName, outputFile string) {
 		return
 	}
 	log.Printf("Metadata for %s saved to %s", dbName, outputFile)
+
+	if hydrate {
+		ext := filepath.Ext(outputFile)
+		failuresFile := strings.TrimSuffix(outputFile, ext) + "_failures.json"
+		data, err := json.MarshalIndent(failures, "", "  ")
+		if err != nil {
+			log.Printf("Failed to marshal failures for %s: %v", dbName, err)
+			return
+		}
+		if err := os.WriteFile(failuresFile, data, 0644); err != nil {
+			log.Printf("Failed to write failures to %s: %v", failuresFile, err)
+			return
+		}
+		log.Printf("Hydrated %d failure completions for %s to %s", len(failures), dbName, failuresFile)
+	}
 }
 
 func main() {
@@ -104,20 +255,17 @@ func main() {
 	}
 	defer client.Disconnect(context.Background())
 
-	// List of databases and corresponding output files
-	databases := []struct {
-		name       string
-		outputFile string
-	}{
-		{"train_evaluation_db", "train_accuracy_metadata.txt"},
-		{"cake_evaluation_db", "cake_accuracy_metadata.txt"},
-		{"bus_evaluation_db", "bus_accuracy_metadata.txt"},
-		{"tree_evaluation_db", "tree_accuracy_metadata.txt"},
-		{"evaluation_db", "shopping_accuracy_metadata.txt"},
+	// Databases and output files are driven by the same manifest the
+	// evaluator uses, so a new activity only needs a manifest entry.
+	activities, err := loadManifest()
+	if err != nil {
+		log.Fatalf("Failed to load benchmarks manifest: %v", err)
 	}
 
+	hydrate := hydrateRequested()
+
 	// Process each database
-	for _, db := range databases {
-		calculateAccuracy(client, db.name, db.outputFile)
+	for _, activity := range activities {
+		calculateAccuracy(client, activity.DBName, activity.AccuracyOutput, hydrate)
 	}
 }
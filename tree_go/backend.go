@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sony/gobreaker"
+	"golang.org/x/time/rate"
+)
+
+// Message is a single chat turn sent to a backend.
+type Message struct {
+	Role    string
+	Content string
+}
+
+// CompletionParams controls sampling behavior for a single completion call.
+type CompletionParams struct {
+	Temperature float64
+	TopP        float64
+}
+
+// Usage reports token accounting for a completion call, when the backend
+// provides it. Backends that don't report usage leave this zeroed.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Backend turns a chat-style prompt into a completion. Shivaay, an
+// OpenAI-compatible endpoint, and a local Ollama endpoint all implement
+// it so processSample doesn't need to know which one is configured.
+type Backend interface {
+	Complete(ctx context.Context, messages []Message, params CompletionParams) (string, Usage, error)
+}
+
+// latencyTracker keeps a bounded window of recent call latencies so
+// BackendMetrics can report p50/p95 without holding every sample ever
+// recorded over a 3.5M-row run.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []float64
+}
+
+func (t *latencyTracker) record(seconds float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, seconds)
+	if len(t.samples) > 10000 {
+		t.samples = t.samples[len(t.samples)-10000:]
+	}
+}
+
+func (t *latencyTracker) percentile(p float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), t.samples...)
+	sort.Float64s(sorted)
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// BackendMetrics accumulates per-backend call counters surfaced in the
+// periodic LogEntry.
+type BackendMetrics struct {
+	attempted   int64
+	retried     int64
+	circuitOpen int64
+	latency     latencyTracker
+}
+
+// Snapshot returns the current counters and latency percentiles (in
+// seconds).
+func (m *BackendMetrics) Snapshot() (attempted, retried, circuitOpen int64, p50, p95 float64) {
+	return atomic.LoadInt64(&m.attempted),
+		atomic.LoadInt64(&m.retried),
+		atomic.LoadInt64(&m.circuitOpen),
+		m.latency.percentile(0.5),
+		m.latency.percentile(0.95)
+}
+
+// backendLimiter is the token-bucket rate limiter shared across all
+// workers and backends, configured via RATE_LIMIT_RPS/RATE_LIMIT_BURST.
+var backendLimiter = rate.NewLimiter(rate.Limit(envFloat("RATE_LIMIT_RPS", 10)), envInt("RATE_LIMIT_BURST", 20))
+
+// backendBreaker trips when the recent error rate across all backend
+// calls crosses a threshold, failing fast for a cooldown period instead
+// of piling up retries against a struggling endpoint.
+var backendBreaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+	Name:        "llm-backend",
+	MaxRequests: 5,
+	Interval:    60 * time.Second,
+	Timeout:     30 * time.Second,
+	ReadyToTrip: func(counts gobreaker.Counts) bool {
+		return counts.Requests >= 10 && float64(counts.TotalFailures)/float64(counts.Requests) >= 0.5
+	},
+})
+
+func envFloat(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// newBackendClient builds the resty client shared by every backend,
+// wired with retry/backoff, the shared rate limiter, and call counting.
+// Retries use resty's built-in jittered exponential backoff between
+// RetryWaitTime and RetryMaxWaitTime.
+func newBackendClient(metrics *BackendMetrics) *resty.Client {
+	client := resty.New().
+		SetTimeout(30 * time.Second).
+		SetRetryCount(5).
+		SetRetryWaitTime(500 * time.Millisecond).
+		SetRetryMaxWaitTime(10 * time.Second).
+		AddRetryCondition(func(r *resty.Response, err error) bool {
+			if err != nil {
+				return true
+			}
+			switch r.StatusCode() {
+			case 408, 429, 500, 502, 503, 504:
+				return true
+			}
+			return false
+		})
+
+	client.OnBeforeRequest(func(c *resty.Client, r *resty.Request) error {
+		if err := backendLimiter.Wait(r.Context()); err != nil {
+			return err
+		}
+		// Counted here, not in OnAfterResponse: this hook fires once per
+		// attempt (including retries) before the request goes out over the
+		// wire, so it still counts attempts that fail at the transport
+		// level (connection refused, DNS, timeout) and never reach
+		// OnAfterResponse at all.
+		atomic.AddInt64(&metrics.attempted, 1)
+		if r.Attempt > 1 {
+			atomic.AddInt64(&metrics.retried, 1)
+		}
+		return nil
+	})
+	client.OnAfterResponse(func(c *resty.Client, r *resty.Response) error {
+		metrics.latency.record(r.Time().Seconds())
+		return nil
+	})
+	return client
+}
+
+// execute runs fn through the shared circuit breaker, bumping
+// metrics.circuitOpen whenever the breaker is already open.
+func execute(metrics *BackendMetrics, fn func() (*resty.Response, error)) (*resty.Response, error) {
+	result, err := backendBreaker.Execute(func() (interface{}, error) {
+		resp, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("backend returned status %d", resp.StatusCode())
+		}
+		return resp, nil
+	})
+	if err != nil {
+		if err == gobreaker.ErrOpenState {
+			atomic.AddInt64(&metrics.circuitOpen, 1)
+		}
+		return nil, err
+	}
+	return result.(*resty.Response), nil
+}
+
+// ShivaayBackend talks to the Shivaay chat-completions endpoint.
+type ShivaayBackend struct {
+	client  *resty.Client
+	metrics *BackendMetrics
+}
+
+func (b *ShivaayBackend) Complete(ctx context.Context, messages []Message, params CompletionParams) (string, Usage, error) {
+	resp, err := execute(b.metrics, func() (*resty.Response, error) {
+		return b.client.R().
+			SetContext(ctx).
+			SetBody(map[string]interface{}{
+				"messages":    toWireMessages(messages),
+				"temperature": params.Temperature,
+				"top_p":       params.TopP,
+				"stream":      false,
+			}).
+			Post("https://shivaay_model_go.futurixai.com/v1/chat/completions")
+	})
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	var parsed struct {
+		Answer string `json:"answer"`
+	}
+	if err := json.Unmarshal(resp.Body(), &parsed); err != nil {
+		return "", Usage{}, fmt.Errorf("shivaay backend: decode response: %w", err)
+	}
+	return parsed.Answer, Usage{}, nil
+}
+
+// OpenAIBackend talks to any OpenAI-compatible /v1/chat/completions API.
+type OpenAIBackend struct {
+	client  *resty.Client
+	baseURL string
+	apiKey  string
+	model   string
+	metrics *BackendMetrics
+}
+
+func (b *OpenAIBackend) Complete(ctx context.Context, messages []Message, params CompletionParams) (string, Usage, error) {
+	resp, err := execute(b.metrics, func() (*resty.Response, error) {
+		return b.client.R().
+			SetContext(ctx).
+			SetHeader("Authorization", "Bearer "+b.apiKey).
+			SetBody(map[string]interface{}{
+				"model":       b.model,
+				"messages":    toWireMessages(messages),
+				"temperature": params.Temperature,
+				"top_p":       params.TopP,
+			}).
+			Post(b.baseURL + "/v1/chat/completions")
+	})
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	var parsed struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(resp.Body(), &parsed); err != nil {
+		return "", Usage{}, fmt.Errorf("openai backend: decode response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", Usage{}, fmt.Errorf("openai backend: no choices in response")
+	}
+	usage := Usage{PromptTokens: parsed.Usage.PromptTokens, CompletionTokens: parsed.Usage.CompletionTokens}
+	return parsed.Choices[0].Message.Content, usage, nil
+}
+
+// OllamaBackend talks to a local Ollama /api/chat endpoint.
+type OllamaBackend struct {
+	client  *resty.Client
+	baseURL string
+	model   string
+	metrics *BackendMetrics
+}
+
+func (b *OllamaBackend) Complete(ctx context.Context, messages []Message, params CompletionParams) (string, Usage, error) {
+	resp, err := execute(b.metrics, func() (*resty.Response, error) {
+		return b.client.R().
+			SetContext(ctx).
+			SetBody(map[string]interface{}{
+				"model":    b.model,
+				"messages": toWireMessages(messages),
+				"stream":   false,
+				"options": map[string]interface{}{
+					"temperature": params.Temperature,
+					"top_p":       params.TopP,
+				},
+			}).
+			Post(b.baseURL + "/api/chat")
+	})
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	var parsed struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		PromptEvalCount int `json:"prompt_eval_count"`
+		EvalCount       int `json:"eval_count"`
+	}
+	if err := json.Unmarshal(resp.Body(), &parsed); err != nil {
+		return "", Usage{}, fmt.Errorf("ollama backend: decode response: %w", err)
+	}
+	return parsed.Message.Content, Usage{PromptTokens: parsed.PromptEvalCount, CompletionTokens: parsed.EvalCount}, nil
+}
+
+func toWireMessages(messages []Message) []map[string]string {
+	wire := make([]map[string]string, len(messages))
+	for i, m := range messages {
+		wire[i] = map[string]string{"role": m.Role, "content": m.Content}
+	}
+	return wire
+}
+
+// newBackend selects and constructs the configured Backend from the
+// BACKEND env var ("shivaay" [default], "openai", "ollama").
+func newBackend(metrics *BackendMetrics) Backend {
+	client := newBackendClient(metrics)
+	switch strings.ToLower(os.Getenv("BACKEND")) {
+	case "openai":
+		return &OpenAIBackend{
+			client:  client,
+			baseURL: envOrDefault("OPENAI_BASE_URL", "https://api.openai.com"),
+			apiKey:  os.Getenv("OPENAI_API_KEY"),
+			model:   envOrDefault("OPENAI_MODEL", "gpt-4o-mini"),
+			metrics: metrics,
+		}
+	case "ollama":
+		return &OllamaBackend{
+			client:  client,
+			baseURL: envOrDefault("OLLAMA_BASE_URL", "http://localhost:11434"),
+			model:   envOrDefault("OLLAMA_MODEL", "llama3"),
+			metrics: metrics,
+		}
+	default:
+		return &ShivaayBackend{client: client, metrics: metrics}
+	}
+}
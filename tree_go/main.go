@@ -2,25 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/rand/v2"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/go-resty/resty/v2"
+	"github.com/bits-and-blooms/bloom/v3"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -31,8 +40,6 @@ const (
 	NShot         = 4
 	BatchSize     = 100
 	WorkerCount   = 50
-	Activity      = "shopping"
-	ActivityName  = "going grocery shopping"
 	AnswerTrigger = "Answer:"
 	InvalidAns    = "[invalid]"
 )
@@ -46,28 +53,94 @@ type Sample struct {
 	Label    string `json:"label"` // "0" or "1"
 }
 
-// Response represents the result of processing a sample
+// Response represents the result of processing a sample. ModelCompletion
+// and RenderedPrompt are transient (bson:"-"); CompletionRef/PromptRef, or
+// the *Inline fallback, hold what's actually persisted (see uploadBatch).
 type Response struct {
-	Premise         string  `bson:"premise"`
-	Choice1         string  `bson:"choice1"`
-	Choice2         string  `bson:"choice2"`
-	CausalQuestion  string  `bson:"causal_question"`
-	CorrectAnswer   string  `bson:"correct_answer"`
-	ModelAnswer     string  `bson:"model_answer"`
-	ModelCompletion string  `bson:"model_completion"`
-	IsCorrect       bool    `bson:"is_correct"`
-	IsInvalid       bool    `bson:"is_invalid"`
-	ProcessingTime  float64 `bson:"processing_time"`
+	SampleID         string              `bson:"sample_id"`
+	Premise          string              `bson:"premise"`
+	Choice1          string              `bson:"choice1"`
+	Choice2          string              `bson:"choice2"`
+	CausalQuestion   string              `bson:"causal_question"`
+	CorrectAnswer    string              `bson:"correct_answer"`
+	ModelAnswer      string              `bson:"model_answer"`
+	ModelCompletion  string              `bson:"-"`
+	CompletionHash   string              `bson:"completion_hash"`
+	CompletionRef    *primitive.ObjectID `bson:"completion_ref,omitempty"`
+	CompletionInline string              `bson:"completion_inline,omitempty"`
+	RenderedPrompt   string              `bson:"-"`
+	PromptRef        *primitive.ObjectID `bson:"prompt_ref,omitempty"`
+	PromptInline     string              `bson:"prompt_inline,omitempty"`
+	IsCorrect        bool                `bson:"is_correct"`
+	IsInvalid        bool                `bson:"is_invalid"`
+	ProcessingTime   float64             `bson:"processing_time"`
+	Votes            []VoteRecord        `bson:"votes,omitempty"`
+}
+
+// VoteRecord captures one self-consistency sample (one of the K calls for
+// a question) so maj@K can be recomputed offline. Completion and Prompt
+// are transient; only CompletionRef/CompletionInline are persisted.
+type VoteRecord struct {
+	Answer           string              `bson:"answer"`
+	Completion       string              `bson:"-"`
+	CompletionHash   string              `bson:"completion_hash"`
+	CompletionRef    *primitive.ObjectID `bson:"completion_ref,omitempty"`
+	CompletionInline string              `bson:"completion_inline,omitempty"`
+	ProcessingTime   float64             `bson:"processing_time"`
+	Prompt           string              `bson:"-"`
+}
+
+// contentHash returns a hex-encoded SHA-256 of s, used to dedup GridFS
+// uploads of identical completions/prompts (e.g. repeated invalid
+// answers) instead of storing the same bytes once per row.
+func contentHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checkpoint records the progress counters a resumed run uses to restore
+// the stats behind the periodic log, plus the CSV byte offset reached.
+// Skipping samples already in resultsColl is done by the Bloom filter
+// (see loadSeenIDs), not by this checkpoint.
+type Checkpoint struct {
+	Timestamp        string  `bson:"timestamp"`
+	CSVOffset        int64   `bson:"csv_offset"`
+	TotalDone        int32   `bson:"total_done"`
+	CorrectDone      int32   `bson:"correct_done"`
+	InvalidDone      int32   `bson:"invalid_done"`
+	TiedVotesDone    int32   `bson:"tied_votes_done"`
+	TotalTimeSeconds float64 `bson:"total_time_seconds"`
+	ElapsedSeconds   float64 `bson:"elapsed_seconds"`
+}
+
+// sampleID derives a stable, content-addressed ID for a sample so reruns
+// can detect work that's already been persisted.
+func sampleID(sample Sample) string {
+	h := sha256.New()
+	h.Write([]byte(sample.Premise))
+	h.Write([]byte("\x00"))
+	h.Write([]byte(sample.Choice1))
+	h.Write([]byte("\x00"))
+	h.Write([]byte(sample.Choice2))
+	h.Write([]byte("\x00"))
+	h.Write([]byte(sample.Question))
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // LogEntry for real-time accuracy logs
 type LogEntry struct {
-	Timestamp      string `bson:"timestamp"`
-	TotalQuestions int    `bson:"total_questions"`
-	CorrectNum     int    `bson:"correct_num"`
-	Accuracy       string `bson:"accuracy"`
-	InvalidAnswers int    `bson:"invalid_answers"`
-	ETA            string `bson:"eta"`
+	Timestamp          string  `bson:"timestamp"`
+	TotalQuestions     int     `bson:"total_questions"`
+	CorrectNum         int     `bson:"correct_num"`
+	Accuracy           string  `bson:"accuracy"`
+	InvalidAnswers     int     `bson:"invalid_answers"`
+	TiedVotes          int     `bson:"tied_votes"`
+	BackendAttempted   int64   `bson:"backend_attempted"`
+	BackendRetried     int64   `bson:"backend_retried"`
+	BackendCircuitOpen int64   `bson:"backend_circuit_open"`
+	BackendP50Ms       float64 `bson:"backend_p50_ms"`
+	BackendP95Ms       float64 `bson:"backend_p95_ms"`
+	ETA                string  `bson:"eta"`
 }
 
 // Stats for tracking progress
@@ -75,31 +148,144 @@ type Stats struct {
 	total     int32
 	correct   int32
 	invalid   int32
+	tiedVotes int32
 	totalTime float64
 }
 
-// Demo examples for few-shot prompting
-var demoExamples = []struct {
-	activityName string
-	premise      string
-	choices      []string
-	question     string
-	answer       string
-}{
-	{"going grocery shopping", "select items from the shelf", []string{"pay at the counter", "leave the store without paying"}, "effect", "A"},
-	{"baking a cake", "mix the batter", []string{"burn the kitchen", "pour batter into a pan"}, "effect", "B"},
-	{"riding on a bus", "board the bus", []string{"buy a ticket", "fly to another city"}, "cause", "A"},
-	{"planting a tree", "dig a hole", []string{"water the plant", "cut down a tree"}, "effect", "A"},
+// DemoExample is one few-shot example used to prime the model for an
+// activity. The manifest supplies a handful of these per activity so
+// prompts are drawn from examples about the activity being evaluated.
+type DemoExample struct {
+	Premise  string `yaml:"premise"`
+	Choice1  string `yaml:"choice1"`
+	Choice2  string `yaml:"choice2"`
+	Question string `yaml:"question"`
+	Answer   string `yaml:"answer"`
+}
+
+// ActivityConfig is one entry from the benchmarks manifest: which CSV to
+// evaluate, which Mongo database to write into, and the few-shot demo
+// examples to draw from for that activity.
+type ActivityConfig struct {
+	Name           string        `yaml:"activity_name"`
+	DisplayName    string        `yaml:"display_name"`
+	CSVPath        string        `yaml:"csv_path"`
+	DBName         string        `yaml:"db_name"`
+	AccuracyOutput string        `yaml:"accuracy_output"`
+	DemoExamples   []DemoExample `yaml:"demo_examples"`
+}
+
+// loadManifest reads the activity manifest (benchmarks.yaml by default,
+// or BENCHMARKS_MANIFEST if set) so adding a new activity is a
+// single-file change instead of a binary rebuild.
+func loadManifest() ([]ActivityConfig, error) {
+	path := envOrDefault("BENCHMARKS_MANIFEST", "benchmarks.yaml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	var manifest struct {
+		Activities []ActivityConfig `yaml:"activities"`
+	}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", path, err)
+	}
+	if len(manifest.Activities) == 0 {
+		return nil, fmt.Errorf("manifest %s defines no activities", path)
+	}
+	return manifest.Activities, nil
 }
 
 var answerRegex = regexp.MustCompile(`\b(A|B)\b`)
 
-// MongoDB collections
-var (
-	db          *mongo.Database
-	resultsColl *mongo.Collection
-	logsColl    *mongo.Collection
-)
+// mongoClient is shared across activities; each activity gets its own
+// database off of it.
+var mongoClient *mongo.Client
+
+// activityRun holds everything one activity's evaluation pass needs:
+// its manifest config, demo examples, Mongo collections, and stats.
+type activityRun struct {
+	cfg               ActivityConfig
+	resultsColl       *mongo.Collection
+	logsColl          *mongo.Collection
+	checkpointsColl   *mongo.Collection
+	completionsBucket *gridfs.Bucket
+	stats             *Stats
+}
+
+// resumeMode is true when this run should pick up where a previous one
+// left off instead of starting from an empty database.
+var resumeMode bool
+
+// nConsistency is the number of self-consistency samples drawn per
+// question. 1 (the default) reproduces the old greedy@1 behavior.
+var nConsistency int
+
+// storePrompt is true when the rendered prompt (not just the completion)
+// should also be offloaded to GridFS, for runs that need to reproduce
+// exactly what the model saw during failure analysis.
+var storePrompt bool
+
+// llmBackend is the configured completion backend (Shivaay, OpenAI-
+// compatible, or Ollama), selected via the BACKEND env var. runActivity
+// rebuilds it around a fresh backendMetrics at the start of every
+// activity; activities run one at a time, so this is safe without a lock.
+var llmBackend Backend
+
+// backendMetrics tracks call counters for whichever backend is active.
+// Reset per activity (see llmBackend) so one activity's LogEntry.Backend*
+// figures don't include counts and latencies left over from another.
+var backendMetrics *BackendMetrics
+
+// resumeRequested inspects the command line and environment for a resume
+// request. It's checked this early (from init, before flag.Parse would
+// normally run) so the decision is made before we touch Mongo collections.
+func resumeRequested() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--resume" || arg == "-resume" {
+			return true
+		}
+	}
+	switch strings.ToLower(os.Getenv("RESUME")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// storePromptRequested inspects the command line and environment for a
+// request to also offload rendered prompts to GridFS alongside
+// completions.
+func storePromptRequested() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--store-prompt" || arg == "-store-prompt" {
+			return true
+		}
+	}
+	switch strings.ToLower(os.Getenv("STORE_PROMPT")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// consistencySamples resolves --n-consistency=K from the command line, or
+// N_CONSISTENCY from the environment, falling back to 1 (greedy@1).
+func consistencySamples() int {
+	for _, arg := range os.Args[1:] {
+		if v, ok := strings.CutPrefix(arg, "--n-consistency="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	if v := os.Getenv("N_CONSISTENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
 
 func init() {
 	// Load .env file
@@ -107,18 +293,164 @@ func init() {
 		log.Println("No .env file found")
 	}
 
-	// Connect to MongoDB
+	resumeMode = resumeRequested()
+	nConsistency = consistencySamples()
+	storePrompt = storePromptRequested()
+
+	// Connect to MongoDB. Each activity gets its own database off of this
+	// shared client (see setupActivityCollections).
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(MongoURI))
 	if err != nil {
 		log.Fatal(err)
 	}
-	db = client.Database("tree_evaluation_db")
-	resultsColl = db.Collection("results")
-	logsColl = db.Collection("logs")
+	mongoClient = client
+}
+
+// setupActivityCollections gets (and, outside resume mode, resets) the
+// results/logs/checkpoints collections and GridFS bucket for one
+// activity's database.
+func setupActivityCollections(cfg ActivityConfig) (db *mongo.Database, results, logs, checkpoints *mongo.Collection, bucket *gridfs.Bucket) {
+	activityDB := mongoClient.Database(cfg.DBName)
+	results = activityDB.Collection("results")
+	logs = activityDB.Collection("logs")
+	checkpoints = activityDB.Collection("checkpoints")
+
+	if !resumeMode {
+		results.Drop(context.Background())
+		logs.Drop(context.Background())
+		checkpoints.Drop(context.Background())
+		activityDB.Collection("fs.files").Drop(context.Background())
+		activityDB.Collection("fs.chunks").Drop(context.Background())
+	} else {
+		log.Printf("Resume mode enabled for %s: keeping existing results/logs/checkpoints", cfg.Name)
+	}
 
-	// Clear collections (optional)
-	resultsColl.Drop(context.Background())
-	logsColl.Drop(context.Background())
+	// sample_id must be unique so upserts can overwrite a partial re-run
+	// cleanly instead of duplicating rows.
+	_, err := results.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "sample_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create unique index on sample_id for %s: %v", cfg.Name, err)
+	}
+
+	// With completions offloaded to GridFS, results documents are small
+	// enough that this compound index comfortably fits in RAM, keeping
+	// the accuracy tool's scans index-only.
+	_, err = results.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "is_correct", Value: 1}, {Key: "is_invalid", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create is_correct/is_invalid index for %s: %v", cfg.Name, err)
+	}
+
+	bucket, err = gridfs.NewBucket(activityDB)
+	if err != nil {
+		log.Fatalf("Failed to open GridFS bucket for %s: %v", cfg.Name, err)
+	}
+	return activityDB, results, logs, checkpoints, bucket
+}
+
+// loadSeenIDs builds a Bloom filter over the sample IDs already present in
+// resultsColl, so the CSV loader can cheaply skip samples a previous run
+// already finished without holding the full ID set in memory.
+func loadSeenIDs(ctx context.Context, resultsColl *mongo.Collection) *bloom.BloomFilter {
+	filter := bloom.NewWithEstimates(4_000_000, 0.01)
+	if !resumeMode {
+		return filter
+	}
+
+	cursor, err := resultsColl.Find(ctx, bson.D{}, options.Find().SetProjection(bson.D{{Key: "sample_id", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to load existing sample IDs for resume: %v", err)
+		return filter
+	}
+	defer cursor.Close(ctx)
+
+	var loaded int
+	for cursor.Next(ctx) {
+		var doc struct {
+			SampleID string `bson:"sample_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		filter.AddString(doc.SampleID)
+		loaded++
+	}
+	log.Printf("Resume: loaded %d previously completed sample IDs", loaded)
+	return filter
+}
+
+// loadGridFSCache rebuilds the hash->ObjectID cache the batch writer uses
+// to skip re-uploading a completion/prompt it's already seen, from the
+// files already sitting in bucket (uploadOnce names each file after its
+// hash). Without this, a resumed run's cache starts empty and re-uploads
+// a fresh duplicate blob for every hash it happens to see again, even
+// though the bucket already has one from before the crash.
+func loadGridFSCache(ctx context.Context, bucket *gridfs.Bucket) map[string]primitive.ObjectID {
+	cache := map[string]primitive.ObjectID{}
+	if !resumeMode {
+		return cache
+	}
+
+	cursor, err := bucket.Find(bson.D{})
+	if err != nil {
+		log.Printf("Failed to load existing GridFS files for resume: %v", err)
+		return cache
+	}
+	defer cursor.Close(ctx)
+
+	var loaded int
+	for cursor.Next(ctx) {
+		var file struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Filename string             `bson:"filename"`
+		}
+		if err := cursor.Decode(&file); err != nil {
+			continue
+		}
+		cache[file.Filename] = file.ID
+		loaded++
+	}
+	log.Printf("Resume: loaded %d previously uploaded GridFS blobs for dedup", loaded)
+	return cache
+}
+
+// loadLatestCheckpoint fetches the most recently written checkpoint for
+// this activity, if any, so a resumed run can seed Stats instead of
+// reporting accuracy/ETA computed only since the restart.
+//
+// CSVOffset is kept for visibility only, never used to seek: the counting
+// reader's offset can run ahead of the last record csv.Reader yielded, so
+// seeking risks skipping rows that were never actually read. The Bloom
+// filter over persisted sample IDs is resume's real correctness gate.
+func loadLatestCheckpoint(ctx context.Context, checkpointsColl *mongo.Collection) (Checkpoint, bool) {
+	var checkpoint Checkpoint
+	err := checkpointsColl.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})).Decode(&checkpoint)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to load latest checkpoint: %v", err)
+		}
+		return Checkpoint{}, false
+	}
+	return checkpoint, true
+}
+
+// countingReader wraps an io.Reader and tracks the number of bytes read
+// through it, so the CSV loader can checkpoint its byte offset even
+// though csv.Reader consumes from a buffered reader ahead of the records
+// it yields.
+type countingReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.offset, int64(n))
+	return n, err
 }
 
 // getQuestionText generates the prompt for a sample
@@ -131,16 +463,12 @@ func getQuestionText(activityName, premise string, choices []string, causalQuest
 	)
 }
 
-// createDemoText generates few-shot examples
-func createDemoText(nShot int) string {
-	randExamples := make([]struct {
-		activityName string
-		premise      string
-		choices      []string
-		question     string
-		answer       string
-	}, len(demoExamples))
-	copy(randExamples, demoExamples)
+// createDemoText generates few-shot examples drawn from the given
+// activity's own demo examples, reshuffled each call for prompt-order
+// robustness.
+func createDemoText(examples []DemoExample, activityName string, nShot int) string {
+	randExamples := make([]DemoExample, len(examples))
+	copy(randExamples, examples)
 	rand.Shuffle(len(randExamples), func(i, j int) {
 		randExamples[i], randExamples[j] = randExamples[j], randExamples[i]
 	})
@@ -148,19 +476,20 @@ func createDemoText(nShot int) string {
 	var demo strings.Builder
 	for i := 0; i < nShot && i < len(randExamples); i++ {
 		ex := randExamples[i]
-		demo.WriteString(getQuestionText(ex.activityName, ex.premise, ex.choices, ex.question))
+		demo.WriteString(getQuestionText(activityName, ex.Premise, []string{ex.Choice1, ex.Choice2}, ex.Question))
 		demo.WriteString(" ")
-		demo.WriteString(ex.answer)
+		demo.WriteString(ex.Answer)
 		demo.WriteString("\n\n")
 	}
 	return demo.String()
 }
 
-// buildPrompt constructs the full prompt
-func buildPrompt(sample Sample, nShot int) string {
-	demo := createDemoText(nShot)
+// buildPrompt constructs the full prompt for a sample of the given
+// activity.
+func buildPrompt(run *activityRun, sample Sample) string {
+	demo := createDemoText(run.cfg.DemoExamples, run.cfg.DisplayName, NShot)
 	choices := []string{sample.Choice1, sample.Choice2}
-	questionText := getQuestionText(ActivityName, sample.Premise, choices, sample.Question)
+	questionText := getQuestionText(run.cfg.DisplayName, sample.Premise, choices, sample.Question)
 	return demo + questionText
 }
 
@@ -174,72 +503,99 @@ func cleanAnswer(modelPred string) string {
 	return InvalidAns
 }
 
-// askQuestion makes an API call to get the model’s response
-func askQuestion(inputText string) (string, error) {
-	request := struct {
-		Messages []struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"messages" binding:"required"`
-		Temperature float64 `json:"temperature" binding:"required"`
-		TopP        float64 `json:"top_p" binding:"required"`
-	}{
-		Messages: []struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		}{
-			{Role: "system", Content: "You are an expert assistant. Provide the correct answer (A or B) directly without explanation."},
-			{Role: "user", Content: inputText},
-		},
-		Temperature: 0.7,
-		TopP:        0.9,
-	}
-
-	apiResponse, err := CallExternalAPI(request)
+// askOnce builds a fresh prompt (independently reshuffling the few-shot
+// demos, for prompt-order robustness) and issues a single completion
+// call, recording it as one self-consistency vote.
+func askOnce(run *activityRun, sample Sample) VoteRecord {
+	start := time.Now()
+	inputText := buildPrompt(run, sample)
+	messages := []Message{
+		{Role: "system", Content: "You are an expert assistant. Provide the correct answer (A or B) directly without explanation."},
+		{Role: "user", Content: inputText},
+	}
+	completion, _, err := llmBackend.Complete(context.Background(), messages, CompletionParams{Temperature: 0.7, TopP: 0.9})
 	if err != nil {
-		return "", err
+		log.Printf("Backend error: %v", err)
+		completion = InvalidAns
+	}
+	return VoteRecord{
+		Answer:         cleanAnswer(completion),
+		Completion:     completion,
+		CompletionHash: contentHash(completion),
+		ProcessingTime: time.Since(start).Seconds(),
+		Prompt:         inputText,
 	}
+}
+
+// representativeVote returns the first vote that produced the winning
+// answer, so the persisted completion/prompt actually matches
+// ModelAnswer instead of always reflecting votes[0] regardless of which
+// way the majority went. Falls back to votes[0] if, somehow, no vote
+// matches (shouldn't happen since answer is derived from votes).
+func representativeVote(votes []VoteRecord, answer string) VoteRecord {
+	for _, v := range votes {
+		if v.Answer == answer {
+			return v
+		}
+	}
+	return votes[0]
+}
 
-	var result map[string]string
-	json.Unmarshal(apiResponse.Body(), &result)
-	return result["answer"], nil
-}
-
-func CallExternalAPI(request struct {
-	Messages []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"messages" binding:"required"`
-	Temperature float64 `json:"temperature" binding:"required"`
-	TopP        float64 `json:"top_p" binding:"required"`
-}) (*resty.Response, error) {
-	client := resty.New()
-	apiResponse, err := client.R().
-		SetBody(map[string]interface{}{
-			"messages": []map[string]string{
-				{"role": "system", "content": request.Messages[0].Content},
-				{"role": "user", "content": request.Messages[1].Content},
-			},
-			"temperature": request.Temperature,
-			"top_p":       request.TopP,
-			"stream":      false,
-		}).
-		Post("https://shivaay_model_go.futurixai.com/v1/chat/completions")
-
-	return apiResponse, err
-}
-
-// processSample processes a single sample
-func processSample(sample Sample, stats *Stats) Response {
+// majorityVote picks the answer with the most support among {A, B}. Ties
+// are broken by whichever answer's votes have the lower mean processing
+// time. If no vote produced a valid A/B answer, it returns InvalidAns.
+func majorityVote(votes []VoteRecord) (answer string, tied bool) {
+	counts := map[string]int{}
+	totalTime := map[string]float64{}
+	for _, v := range votes {
+		if v.Answer != "A" && v.Answer != "B" {
+			continue
+		}
+		counts[v.Answer]++
+		totalTime[v.Answer] += v.ProcessingTime
+	}
+	if counts["A"] == 0 && counts["B"] == 0 {
+		return InvalidAns, false
+	}
+	if counts["A"] != counts["B"] {
+		if counts["A"] > counts["B"] {
+			return "A", false
+		}
+		return "B", false
+	}
+	if totalTime["A"]/float64(counts["A"]) <= totalTime["B"]/float64(counts["B"]) {
+		return "A", true
+	}
+	return "B", true
+}
+
+// processSample processes a single sample for the given activity. When
+// nConsistency > 1, it issues that many completions concurrently and
+// takes a majority vote instead of trusting a single greedy call.
+func processSample(run *activityRun, sample Sample) Response {
 	startTime := time.Now()
-	inputText := buildPrompt(sample, NShot)
-	modelCompletion, err := askQuestion(inputText)
-	if err != nil {
-		log.Printf("API error: %v", err)
-		modelCompletion = InvalidAns
+	stats := run.stats
+
+	votes := make([]VoteRecord, nConsistency)
+	if nConsistency > 1 {
+		var g errgroup.Group
+		for i := 0; i < nConsistency; i++ {
+			i := i
+			g.Go(func() error {
+				votes[i] = askOnce(run, sample)
+				return nil
+			})
+		}
+		g.Wait()
+	} else {
+		votes[0] = askOnce(run, sample)
+	}
+
+	modelAnswer, tied := majorityVote(votes)
+	if tied {
+		atomic.AddInt32(&stats.tiedVotes, 1)
 	}
 
-	modelAnswer := cleanAnswer(modelCompletion)
 	correctAnswer := "A"
 	if sample.Label == "1" {
 		correctAnswer = "B"
@@ -257,18 +613,145 @@ func processSample(sample Sample, stats *Stats) Response {
 	atomic.AddInt32(&stats.total, 1)
 	stats.totalTime += time.Since(startTime).Seconds()
 
-	return Response{
+	winner := representativeVote(votes, modelAnswer)
+	response := Response{
+		SampleID:        sampleID(sample),
 		Premise:         sample.Premise,
 		Choice1:         sample.Choice1,
 		Choice2:         sample.Choice2,
 		CausalQuestion:  sample.Question,
 		CorrectAnswer:   correctAnswer,
 		ModelAnswer:     modelAnswer,
-		ModelCompletion: modelCompletion,
+		ModelCompletion: winner.Completion,
+		CompletionHash:  contentHash(winner.Completion),
 		IsCorrect:       isCorrect,
 		IsInvalid:       isInvalid,
 		ProcessingTime:  time.Since(startTime).Seconds(),
 	}
+	if storePrompt {
+		response.RenderedPrompt = winner.Prompt
+	}
+	if nConsistency > 1 {
+		response.Votes = votes
+	}
+	return response
+}
+
+// downloadText fetches the text previously uploaded to the activity's
+// GridFS bucket under id, for hydrating a completion/prompt back onto a
+// Response read out of resultsColl (which holds the ref, or the text
+// inline only when the GridFS upload failed).
+func downloadText(bucket *gridfs.Bucket, id primitive.ObjectID) (string, error) {
+	var buf bytes.Buffer
+	if _, err := bucket.DownloadToStream(id, &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// hydrateCompletion fills res.ModelCompletion, and each of res.Votes'
+// Completion, from wherever the flush loop actually put it
+// (CompletionInline, or a GridFS blob behind CompletionRef) so the JSON
+// export below reflects the real completions instead of the zero value
+// they always decode to (both are bson:"-" in the persisted document).
+func hydrateCompletion(bucket *gridfs.Bucket, res *Response) {
+	res.ModelCompletion = resolveCompletionText(bucket, res.SampleID, res.CompletionInline, res.CompletionRef)
+	for i := range res.Votes {
+		v := &res.Votes[i]
+		v.Completion = resolveCompletionText(bucket, res.SampleID, v.CompletionInline, v.CompletionRef)
+	}
+}
+
+// resolveCompletionText returns inline if set, else downloads ref from
+// bucket, else "".
+func resolveCompletionText(bucket *gridfs.Bucket, sampleID, inline string, ref *primitive.ObjectID) string {
+	switch {
+	case inline != "":
+		return inline
+	case ref != nil:
+		text, err := downloadText(bucket, *ref)
+		if err != nil {
+			log.Printf("Failed to hydrate completion %s from GridFS: %v", sampleID, err)
+			return ""
+		}
+		return text
+	}
+	return ""
+}
+
+// uploadOnce uploads text to the activity's GridFS bucket under the given
+// hash as its filename. It opens its own Bucket rather than taking a
+// shared one: concurrent OpenUploadStream calls on the same *gridfs.Bucket
+// race on its unsynchronized firstWriteDone field, and a Bucket is cheap
+// enough to construct per call.
+func uploadOnce(db *mongo.Database, hash, text string) (primitive.ObjectID, error) {
+	bucket, err := gridfs.NewBucket(db)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	stream, err := bucket.OpenUploadStream(hash)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if _, err := stream.Write([]byte(text)); err != nil {
+		stream.Close()
+		return primitive.NilObjectID, err
+	}
+	if err := stream.Close(); err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, ok := stream.FileID.(primitive.ObjectID)
+	if !ok {
+		return primitive.NilObjectID, fmt.Errorf("unexpected GridFS file id type %T", stream.FileID)
+	}
+	return id, nil
+}
+
+// uploadBatch offloads each not-yet-cached hash/text pair in items to
+// GridFS concurrently, so one flush tick's distinct completions/prompts
+// go over the wire in parallel instead of one round-trip at a time.
+// cache is owned exclusively by the batch writer goroutine and is only
+// mutated here after all uploads finish, so it needs no locking. Returns
+// the upload error for any hash that failed; everything else is left in
+// cache for the caller to read back.
+func uploadBatch(db *mongo.Database, cache map[string]primitive.ObjectID, items map[string]string) map[string]error {
+	type job struct{ hash, text string }
+	var jobs []job
+	for hash, text := range items {
+		if _, ok := cache[hash]; !ok {
+			jobs = append(jobs, job{hash, text})
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	type outcome struct {
+		hash string
+		id   primitive.ObjectID
+		err  error
+	}
+	outcomes := make([]outcome, len(jobs))
+	var g errgroup.Group
+	for i, j := range jobs {
+		i, j := i, j
+		g.Go(func() error {
+			id, err := uploadOnce(db, j.hash, j.text)
+			outcomes[i] = outcome{hash: j.hash, id: id, err: err}
+			return nil
+		})
+	}
+	g.Wait()
+
+	errs := make(map[string]error)
+	for _, o := range outcomes {
+		if o.err != nil {
+			errs[o.hash] = o.err
+			continue
+		}
+		cache[o.hash] = o.id
+	}
+	return errs
 }
 
 // formatTime converts seconds to a human-readable string
@@ -282,9 +765,49 @@ func formatTime(seconds float64) string {
 	return fmt.Sprintf("%dm %ds", minutes, secs)
 }
 
-func main() {
+// runActivity runs one full evaluation pass (CSV load, worker pool,
+// batched writes, JSON export) for a single manifest activity.
+func runActivity(cfg ActivityConfig) {
+	log.Printf("Starting evaluation for activity %q (%s)", cfg.Name, cfg.DisplayName)
+
+	// Fresh metrics (and the backend client built around them) for this
+	// activity, so its LogEntry.Backend* figures don't include counts and
+	// latencies accumulated while evaluating a prior activity in the
+	// manifest loop in main().
+	backendMetrics = &BackendMetrics{}
+	llmBackend = newBackend(backendMetrics)
+
+	activityDB, resultsColl, logsColl, checkpointsColl, completionsBucket := setupActivityCollections(cfg)
+	run := &activityRun{
+		cfg:               cfg,
+		resultsColl:       resultsColl,
+		logsColl:          logsColl,
+		checkpointsColl:   checkpointsColl,
+		completionsBucket: completionsBucket,
+		stats:             &Stats{},
+	}
+	stats := run.stats
+
+	// priorElapsed is the wall-clock time this activity already spent
+	// across earlier (crashed/restarted) runs, so the final "Total time"
+	// summary reports cumulative time instead of just this process's
+	// uptime. Unlike stats.totalTime (sum of per-sample processing time,
+	// used for the periodic ETA), this tracks actual wall-clock elapsed.
+	var priorElapsed float64
+	if resumeMode {
+		if checkpoint, ok := loadLatestCheckpoint(context.Background(), checkpointsColl); ok {
+			stats.total = checkpoint.TotalDone
+			stats.correct = checkpoint.CorrectDone
+			stats.invalid = checkpoint.InvalidDone
+			stats.tiedVotes = checkpoint.TiedVotesDone
+			stats.totalTime = checkpoint.TotalTimeSeconds
+			priorElapsed = checkpoint.ElapsedSeconds
+			log.Printf("[%s] Resuming from checkpoint: %d done (%d correct, %d invalid) as of %s",
+				cfg.Name, checkpoint.TotalDone, checkpoint.CorrectDone, checkpoint.InvalidDone, checkpoint.Timestamp)
+		}
+	}
+
 	startTime := time.Now()
-	stats := &Stats{}
 	var wg sync.WaitGroup
 
 	// Channels for samples and results
@@ -297,21 +820,26 @@ func main() {
 		go func() {
 			defer wg.Done()
 			for sample := range samplesChan {
-				result := processSample(sample, stats)
+				result := processSample(run, sample)
 				resultsChan <- result
 			}
 		}()
 	}
 
+	seenIDs := loadSeenIDs(context.Background(), resultsColl)
+	var csvOffset int64
+	var skippedViaBloom int64
+
 	// Load dataset from CSV
 	go func() {
-		file, err := os.Open("planting_a_tree.csv")
+		file, err := os.Open(cfg.CSVPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer file.Close()
 
-		reader := csv.NewReader(bufio.NewReader(file))
+		counting := &countingReader{r: file}
+		reader := csv.NewReader(bufio.NewReader(counting))
 		header, err := reader.Read() // Skip header
 		if err != nil {
 			log.Fatal(err)
@@ -325,6 +853,7 @@ func main() {
 
 		for {
 			record, err := reader.Read()
+			atomic.StoreInt64(&csvOffset, atomic.LoadInt64(&counting.offset))
 			if err != nil {
 				break // EOF or error
 			}
@@ -335,51 +864,167 @@ func main() {
 				Question: record[colMap["question"]],
 				Label:    record[colMap["label"]],
 			}
+			if resumeMode && seenIDs.TestString(sampleID(sample)) {
+				// A false positive here permanently drops a sample that
+				// was never actually processed, so it's worth surfacing
+				// rather than leaving this silent at 3.5M-row scale.
+				atomic.AddInt64(&skippedViaBloom, 1)
+				continue
+			}
 			samplesChan <- sample
 		}
+		if skipped := atomic.LoadInt64(&skippedViaBloom); skipped > 0 {
+			log.Printf("[%s] Resume: skipped %d samples already marked done (Bloom filter match)", cfg.Name, skipped)
+		}
 		close(samplesChan)
 	}()
 
 	// Collect results and write to MongoDB
 	go func() {
-		var batch []interface{}
+		var batch []Response
+		completionCache := loadGridFSCache(context.Background(), completionsBucket)
+		promptCache := loadGridFSCache(context.Background(), completionsBucket)
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 
+		// flush offloads each buffered response's completion (and, if
+		// storePrompt is set, rendered prompt) to GridFS, uploading every
+		// distinct one concurrently within this flush tick instead of
+		// one round-trip per sample, then bulk-upserts the now-small
+		// result documents.
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+
+			completionItems := make(map[string]string)
+			promptItems := make(map[string]string)
+			for i := range batch {
+				result := &batch[i]
+				if result.ModelCompletion != "" {
+					completionItems[result.CompletionHash] = result.ModelCompletion
+				}
+				for j := range result.Votes {
+					if vote := &result.Votes[j]; vote.Completion != "" {
+						completionItems[vote.CompletionHash] = vote.Completion
+					}
+				}
+				if storePrompt && result.RenderedPrompt != "" {
+					promptItems[contentHash(result.RenderedPrompt)] = result.RenderedPrompt
+				}
+			}
+			completionErrs := uploadBatch(activityDB, completionCache, completionItems)
+			var promptErrs map[string]error
+			if storePrompt {
+				promptErrs = uploadBatch(activityDB, promptCache, promptItems)
+			}
+
+			models := make([]mongo.WriteModel, 0, len(batch))
+			for i := range batch {
+				result := &batch[i]
+				if result.ModelCompletion != "" {
+					if err, failed := completionErrs[result.CompletionHash]; failed {
+						log.Printf("GridFS completion upload failed, falling back to inline storage: %v", err)
+						result.CompletionInline = result.ModelCompletion
+					} else {
+						id := completionCache[result.CompletionHash]
+						result.CompletionRef = &id
+					}
+				}
+				for j := range result.Votes {
+					vote := &result.Votes[j]
+					if vote.Completion == "" {
+						continue
+					}
+					if err, failed := completionErrs[vote.CompletionHash]; failed {
+						log.Printf("GridFS vote completion upload failed, falling back to inline storage: %v", err)
+						vote.CompletionInline = vote.Completion
+					} else {
+						id := completionCache[vote.CompletionHash]
+						vote.CompletionRef = &id
+					}
+				}
+				if storePrompt && result.RenderedPrompt != "" {
+					promptHash := contentHash(result.RenderedPrompt)
+					if err, failed := promptErrs[promptHash]; failed {
+						log.Printf("GridFS prompt upload failed, falling back to inline storage: %v", err)
+						result.PromptInline = result.RenderedPrompt
+					} else {
+						id := promptCache[promptHash]
+						result.PromptRef = &id
+					}
+				}
+				// Upsert by sample_id so a rerun over already-processed
+				// rows overwrites cleanly instead of duplicating them.
+				update := bson.M{"$set": *result}
+				models = append(models, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"sample_id": result.SampleID}).
+					SetUpdate(update).
+					SetUpsert(true))
+			}
+			if _, err := resultsColl.BulkWrite(context.Background(), models); err != nil {
+				log.Printf("Bulk upsert failed: %v", err)
+			}
+			batch = nil
+		}
+
+		writeCheckpoint := func(total, correct, invalid, tiedVotes int32, totalTime, elapsedSeconds float64) {
+			checkpoint := Checkpoint{
+				Timestamp:        time.Now().Format(time.RFC3339),
+				CSVOffset:        atomic.LoadInt64(&csvOffset),
+				TotalDone:        total,
+				CorrectDone:      correct,
+				InvalidDone:      invalid,
+				TiedVotesDone:    tiedVotes,
+				TotalTimeSeconds: totalTime,
+				ElapsedSeconds:   elapsedSeconds,
+			}
+			if _, err := checkpointsColl.InsertOne(context.Background(), checkpoint); err != nil {
+				log.Printf("Failed to write checkpoint: %v", err)
+			}
+		}
+
 		for {
 			select {
 			case result, ok := <-resultsChan:
 				if !ok {
-					if len(batch) > 0 {
-						resultsColl.InsertMany(context.Background(), batch)
-					}
+					flush()
+					writeCheckpoint(atomic.LoadInt32(&stats.total), atomic.LoadInt32(&stats.correct), atomic.LoadInt32(&stats.invalid), atomic.LoadInt32(&stats.tiedVotes), stats.totalTime, priorElapsed+time.Since(startTime).Seconds())
 					return
 				}
 				batch = append(batch, result)
 				if len(batch) >= BatchSize {
-					resultsColl.InsertMany(context.Background(), batch)
-					batch = nil
+					flush()
 				}
 			case <-ticker.C:
 				total := atomic.LoadInt32(&stats.total)
 				correct := atomic.LoadInt32(&stats.correct)
 				invalid := atomic.LoadInt32(&stats.invalid)
+				tiedVotes := atomic.LoadInt32(&stats.tiedVotes)
 				accuracy := float64(correct) / float64(total) * 100
 				avgTime := stats.totalTime / float64(total)
 				remaining := float64(3500000-total) * avgTime // 3.5M rows
 				eta := formatTime(remaining)
 
+				attempted, retried, circuitOpen, p50, p95 := backendMetrics.Snapshot()
 				logEntry := LogEntry{
-					Timestamp:      time.Now().Format(time.RFC3339),
-					TotalQuestions: int(total),
-					CorrectNum:     int(correct),
-					Accuracy:       fmt.Sprintf("%.2f%%", accuracy),
-					InvalidAnswers: int(invalid),
-					ETA:            eta,
+					Timestamp:          time.Now().Format(time.RFC3339),
+					TotalQuestions:     int(total),
+					CorrectNum:         int(correct),
+					Accuracy:           fmt.Sprintf("%.2f%%", accuracy),
+					InvalidAnswers:     int(invalid),
+					TiedVotes:          int(tiedVotes),
+					BackendAttempted:   attempted,
+					BackendRetried:     retried,
+					BackendCircuitOpen: circuitOpen,
+					BackendP50Ms:       p50 * 1000,
+					BackendP95Ms:       p95 * 1000,
+					ETA:                eta,
 				}
 				logsColl.InsertOne(context.Background(), logEntry)
-				log.Printf("Processed: %d, Correct: %d, Accuracy: %.2f%%, Invalid: %d, ETA: %s",
-					total, correct, accuracy, invalid, eta)
+				writeCheckpoint(total, correct, invalid, tiedVotes, stats.totalTime, priorElapsed+time.Since(startTime).Seconds())
+				log.Printf("[%s] Processed: %d, Correct: %d, Accuracy: %.2f%%, Invalid: %d, ETA: %s",
+					cfg.Name, total, correct, accuracy, invalid, eta)
 			}
 		}
 	}()
@@ -392,19 +1037,26 @@ func main() {
 	correct := atomic.LoadInt32(&stats.correct)
 	invalid := atomic.LoadInt32(&stats.invalid)
 	accuracy := float64(correct) / float64(total) * 100
-	totalTime := time.Since(startTime).Seconds()
+	totalTime := priorElapsed + time.Since(startTime).Seconds()
 
+	finalAttempted, finalRetried, finalCircuitOpen, finalP50, finalP95 := backendMetrics.Snapshot()
 	finalLog := LogEntry{
-		Timestamp:      time.Now().Format(time.RFC3339),
-		TotalQuestions: int(total),
-		CorrectNum:     int(correct),
-		Accuracy:       fmt.Sprintf("%.2f%%", accuracy),
-		InvalidAnswers: int(invalid),
-		ETA:            formatTime(totalTime),
+		Timestamp:          time.Now().Format(time.RFC3339),
+		TotalQuestions:     int(total),
+		CorrectNum:         int(correct),
+		Accuracy:           fmt.Sprintf("%.2f%%", accuracy),
+		InvalidAnswers:     int(invalid),
+		TiedVotes:          int(atomic.LoadInt32(&stats.tiedVotes)),
+		BackendAttempted:   finalAttempted,
+		BackendRetried:     finalRetried,
+		BackendCircuitOpen: finalCircuitOpen,
+		BackendP50Ms:       finalP50 * 1000,
+		BackendP95Ms:       finalP95 * 1000,
+		ETA:                formatTime(totalTime),
 	}
 	logsColl.InsertOne(context.Background(), finalLog)
-	log.Printf("Evaluation completed! Total time: %s, Accuracy: %.2f%%, Invalid: %d",
-		formatTime(totalTime), accuracy, invalid)
+	log.Printf("[%s] Evaluation completed! Total time: %s, Accuracy: %.2f%%, Invalid: %d",
+		cfg.Name, formatTime(totalTime), accuracy, invalid)
 
 	// Export to JSON
 	results, _ := resultsColl.Find(context.Background(), bson.D{})
@@ -413,10 +1065,11 @@ func main() {
 	for results.Next(context.Background()) {
 		var res Response
 		results.Decode(&res)
+		hydrateCompletion(completionsBucket, &res)
 		allResults = append(allResults, res)
 	}
 	jsonData, _ := json.MarshalIndent(allResults, "", "  ")
-	os.WriteFile("complete_response.json", jsonData, 0644)
+	os.WriteFile(cfg.Name+"_complete_response.json", jsonData, 0644)
 
 	logs, _ := logsColl.Find(context.Background(), bson.D{})
 	defer logs.Close(context.Background())
@@ -427,12 +1080,24 @@ func main() {
 		allLogs = append(allLogs, logEntry)
 	}
 	logsData, _ := json.MarshalIndent(allLogs, "", "  ")
-	os.WriteFile("logs.json", logsData, 0644)
+	os.WriteFile(cfg.Name+"_logs.json", logsData, 0644)
+
+	log.Printf("[%s] Data exported to JSON files.", cfg.Name)
+}
 
-	log.Println("Data exported to JSON files.")
+func main() {
+	manifest, err := loadManifest()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, cfg := range manifest {
+		runActivity(cfg)
+	}
+
+	log.Println("All activities evaluated.")
 	// while true to catch all
 	for {
 		time.Sleep(10 * time.Second)
 	}
-
 }